@@ -0,0 +1,53 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"os"
+
+	"github.com/golang/glog"
+	"github.com/jayunit100/etcd-manager/pkg/volumes"
+)
+
+// AWSVolumes is the Volumes provider for EBS-backed master volumes. This
+// file covers device resolution (FindMountedVolume); FindVolumes and
+// AttachVolume live alongside the rest of the EC2 client plumbing.
+type AWSVolumes struct {
+}
+
+// FindMountedVolume resolves the device a previously-attached EBS volume is
+// mounted at. The device name requested in the original attach call (e.g.
+// /dev/xvdba) is authoritative on older, xen-based instance types, but on
+// Nitro-based instance families (m5, c5, ...) EBS volumes are instead
+// exposed as /dev/nvmeXn1 regardless of the requested name, so we fall back
+// to resolving it via findNVMeVolume when the requested device doesn't
+// (yet) exist.
+func (a *AWSVolumes) FindMountedVolume(volume *volumes.Volume) (string, error) {
+	device := volume.LocalDevice
+	if device != "" {
+		if _, err := os.Stat(device); err == nil {
+			return device, nil
+		}
+		glog.V(4).Infof("requested device %q for volume %q not present yet; checking for an NVMe device", device, volume.ProviderID)
+	}
+
+	nvmeDevice, err := findNVMeVolume(volume.ProviderID)
+	if err != nil {
+		return "", err
+	}
+	return nvmeDevice, nil
+}
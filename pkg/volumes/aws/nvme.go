@@ -0,0 +1,83 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// sysBlockDir is where we look for NVMe block devices; it is a var so tests
+// can point it at a fake sysfs layout.
+var sysBlockDir = "/sys/block"
+
+// findNVMeVolume resolves an EBS volume id (e.g. "vol-0123456789abcdef0") to
+// the /dev/nvmeXn1 device it is attached as.
+//
+// On Nitro-based instance families (m5, c5, ...) EBS volumes no longer show
+// up at the device name requested in the EC2 attach call (e.g. /dev/xvdba);
+// instead they are exposed as NVMe devices whose serial number is the EBS
+// volume id with its dashes stripped (e.g. "vol0123456789abcdef0"). We walk
+// /sys/block/nvme*/device/{serial,model} looking for a match, so that
+// FindMountedVolume can return the real device path instead of spinning
+// forever waiting for a device that will never appear.
+//
+// It is not an error for no match to be found (the volume may simply not be
+// attached as NVMe, e.g. on older xen-based instance types); callers should
+// fall back to the requested LocalDevice in that case.
+func findNVMeVolume(volumeID string) (string, error) {
+	wantSerial := strings.Replace(volumeID, "-", "", -1)
+
+	matches, err := filepath.Glob(filepath.Join(sysBlockDir, "nvme*"))
+	if err != nil {
+		return "", fmt.Errorf("error listing %s: %v", sysBlockDir, err)
+	}
+
+	for _, devPath := range matches {
+		name := filepath.Base(devPath)
+
+		serial, err := readNVMeSysfsAttr(devPath, "serial")
+		if err != nil || serial == "" {
+			// Some kernels populate model instead of (or in addition to) serial
+			serial, err = readNVMeSysfsAttr(devPath, "model")
+			if err != nil {
+				glog.V(4).Infof("unable to read nvme identity for %s: %v", name, err)
+				continue
+			}
+		}
+
+		if strings.TrimSpace(serial) == wantSerial {
+			device := "/dev/" + name + "n1"
+			glog.V(2).Infof("resolved EBS volume %q to NVMe device %q", volumeID, device)
+			return device, nil
+		}
+	}
+
+	return "", nil
+}
+
+func readNVMeSysfsAttr(devPath, attr string) (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(devPath, "device", attr))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFakeNVMeDevice(t *testing.T, root, name, serial string) {
+	t.Helper()
+	dir := filepath.Join(root, name, "device")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("creating fake sysfs dir: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "serial"), []byte(serial+"\n"), 0644); err != nil {
+		t.Fatalf("writing fake serial: %v", err)
+	}
+}
+
+func TestFindNVMeVolume_Xen(t *testing.T) {
+	root, err := ioutil.TempDir("", "sysblock-xen")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	// Xen-based instances never expose nvme* entries at all
+	oldSysBlockDir := sysBlockDir
+	sysBlockDir = root
+	defer func() { sysBlockDir = oldSysBlockDir }()
+
+	device, err := findNVMeVolume("vol-0123456789abcdef0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if device != "" {
+		t.Errorf("expected no device to be found, got %q", device)
+	}
+}
+
+func TestFindNVMeVolume_Nitro(t *testing.T) {
+	root, err := ioutil.TempDir("", "sysblock-nvme")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	writeFakeNVMeDevice(t, root, "nvme0", "vol0123456789abcdef0")
+	writeFakeNVMeDevice(t, root, "nvme1", "vol0fedcba9876543210")
+
+	oldSysBlockDir := sysBlockDir
+	sysBlockDir = root
+	defer func() { sysBlockDir = oldSysBlockDir }()
+
+	device, err := findNVMeVolume("vol-0fedcba9876543210")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if device != "/dev/nvme1n1" {
+		t.Errorf("expected /dev/nvme1n1, got %q", device)
+	}
+}
+
+func TestFindNVMeVolume_NoMatch(t *testing.T) {
+	root, err := ioutil.TempDir("", "sysblock-nomatch")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	writeFakeNVMeDevice(t, root, "nvme0", "volaaaaaaaaaaaaaaaaa")
+
+	oldSysBlockDir := sysBlockDir
+	sysBlockDir = root
+	defer func() { sysBlockDir = oldSysBlockDir }()
+
+	device, err := findNVMeVolume("vol-0123456789abcdef0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if device != "" {
+		t.Errorf("expected no device to be found, got %q", device)
+	}
+}
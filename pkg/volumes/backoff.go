@@ -0,0 +1,73 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// ErrVolumeAttachTimeout is returned when a volume's device does not show up
+// before its deadline, instead of blocking forever.
+var ErrVolumeAttachTimeout = errors.New("timed out waiting for volume to attach")
+
+const (
+	attachPollInitialInterval = 500 * time.Millisecond
+	attachPollFactor          = 1.5
+	attachPollMaxInterval     = 30 * time.Second
+
+	// DefaultAttachTimeout is the overall deadline mountMasterVolumes puts on
+	// attach/mount work unless overridden via SetAttachTimeout. waitForDevice
+	// itself enforces no deadline beyond the one carried by its ctx.
+	DefaultAttachTimeout = 5 * time.Minute
+)
+
+// waitForDevice polls find until it returns a non-empty device path, backing
+// off exponentially between attempts (initial 500ms, factor 1.5, capped at
+// 30s) and giving up with ErrVolumeAttachTimeout once ctx is done.
+func waitForDevice(ctx context.Context, providerID string, find func() (string, error)) (string, error) {
+	start := time.Now()
+	interval := attachPollInitialInterval
+
+	for attempt := 1; ; attempt++ {
+		device, err := find()
+		if err != nil {
+			return "", err
+		}
+		if device != "" {
+			return device, nil
+		}
+
+		elapsed := time.Since(start)
+		glog.Infof("Waiting for volume %q to be mounted (attempt %d, elapsed %s)", providerID, attempt, elapsed.Round(time.Second))
+
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("%w after %s: %v", ErrVolumeAttachTimeout, elapsed.Round(time.Second), ctx.Err())
+		case <-time.After(interval):
+		}
+
+		interval = time.Duration(float64(interval) * attachPollFactor)
+		if interval > attachPollMaxInterval {
+			interval = attachPollMaxInterval
+		}
+	}
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWaitForDevice_ReturnsAsSoonAsFound(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	device, err := waitForDevice(ctx, "vol-1", func() (string, error) {
+		return "/dev/xvdba", nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if device != "/dev/xvdba" {
+		t.Errorf("expected /dev/xvdba, got %q", device)
+	}
+}
+
+func TestWaitForDevice_PropagatesFindError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	wantErr := errors.New("provider exploded")
+	_, err := waitForDevice(ctx, "vol-1", func() (string, error) {
+		return "", wantErr
+	})
+	if err != wantErr {
+		t.Errorf("expected the find error to propagate unwrapped, got %v", err)
+	}
+}
+
+func TestWaitForDevice_TimesOut(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := waitForDevice(ctx, "vol-1", func() (string, error) {
+		return "", nil
+	})
+	elapsed := time.Since(start)
+
+	if !errors.Is(err, ErrVolumeAttachTimeout) {
+		t.Errorf("expected ErrVolumeAttachTimeout, got %v", err)
+	}
+	if elapsed > time.Second {
+		t.Errorf("expected waitForDevice to give up promptly once the context deadline passed, took %s", elapsed)
+	}
+}
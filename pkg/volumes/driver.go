@@ -0,0 +1,313 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// DefaultVolumeDriver is the driver name used for volumes that don't
+// specify one, preserving the original behavior of attaching a block
+// device and formatting it.
+const DefaultVolumeDriver = "block"
+
+// VolumeDriver knows how to make a Volume's backing storage available at a
+// mountpoint. Drivers are registered by name (RegisterVolumeDriver) and
+// selected per-volume via Volume.Driver, similar to the local-volume driver
+// options supported by Docker/Podman. Implementations should be idempotent,
+// since mounting may be retried by the reconcile loop. ctx carries the
+// deadline the caller wants the operation bounded by; drivers that don't
+// poll for anything (tmpfs, bind) can ignore it.
+type VolumeDriver interface {
+	Mount(ctx context.Context, provider Volumes, volume *Volume, mountpoint string, fstype string) error
+}
+
+var volumeDrivers = map[string]VolumeDriver{
+	"block": &blockVolumeDriver{},
+	"tmpfs": &tmpfsVolumeDriver{},
+	"bind":  &bindVolumeDriver{},
+}
+
+// RegisterVolumeDriver adds a VolumeDriver under name, so that volumes with
+// Volume.Driver == name are mounted through it. Out-of-tree drivers can call
+// this (typically from an init function) to extend the set of supported
+// Volume.Driver values.
+func RegisterVolumeDriver(name string, driver VolumeDriver) {
+	volumeDrivers[name] = driver
+}
+
+func volumeDriverName(volume *Volume) string {
+	if volume.Driver == "" {
+		return DefaultVolumeDriver
+	}
+	return volume.Driver
+}
+
+func volumeDriverFor(volume *Volume) (VolumeDriver, error) {
+	name := volumeDriverName(volume)
+	driver := volumeDrivers[name]
+	if driver == nil {
+		return nil, fmt.Errorf("unknown volume driver %q", name)
+	}
+	return driver, nil
+}
+
+// blockVolumeDriver is the original behavior: wait for the attached block
+// device to show up, then format (if needed) and mount it.
+type blockVolumeDriver struct{}
+
+var _ VolumeDriver = &blockVolumeDriver{}
+
+func (d *blockVolumeDriver) Mount(ctx context.Context, provider Volumes, volume *Volume, mountpoint string, fstype string) error {
+	// Wait for the device to show up. Note that the device FindMountedVolume
+	// returns may not be volume.LocalDevice: on Nitro-based instance types
+	// EBS volumes are exposed as NVMe devices (/dev/nvmeXn1), and the
+	// provider is responsible for resolving that real path before returning
+	// it here; we always format/mount whatever device it gives us.
+	device, err := waitForDevice(ctx, volume.ProviderID, func() (string, error) {
+		return provider.FindMountedVolume(volume)
+	})
+	if err != nil {
+		return err
+	}
+	glog.Infof("Found volume %q mounted at device %q", volume.ProviderID, device)
+
+	if volume.Encryption != nil {
+		mapperDevice, err := ensureLuksOpen(device, volume)
+		if err != nil {
+			return err
+		}
+		device = mapperDevice
+		glog.Infof("Using LUKS mapper device %q for volume %q", device, volume.ProviderID)
+	}
+
+	safeFormatAndMount := &mount.SafeFormatAndMount{}
+
+	if Containerized {
+		// Build mount & exec implementations that execute in the host namespaces
+		safeFormatAndMount.Interface = mount.NewNsenterMounter()
+		safeFormatAndMount.Exec = NewNsEnterExec()
+
+		// Note that we don't use PathFor for operations going through safeFormatAndMount,
+		// because NewNsenterMounter and NewNsEnterExec will operate in the host
+	} else {
+		safeFormatAndMount.Interface = mount.New("")
+		safeFormatAndMount.Exec = mount.NewOsExec()
+	}
+
+	// Check if it is already mounted
+	// TODO: can we now use IsLikelyNotMountPoint or IsMountPointMatch instead here
+	mounts, err := safeFormatAndMount.List()
+	if err != nil {
+		return fmt.Errorf("error listing existing mounts: %v", err)
+	}
+
+	var existing []*mount.MountPoint
+	for i := range mounts {
+		m := &mounts[i]
+		glog.V(8).Infof("found existing mount: %v", m)
+		// Note: when containerized, we still list mounts in the host, so we don't need to call PathFor(mountpoint)
+		if m.Path == mountpoint {
+			existing = append(existing, m)
+		}
+	}
+
+	// Mount only if isn't mounted already
+	if len(existing) == 0 {
+		options := []string{}
+
+		glog.Infof("Creating mount directory %q", PathFor(mountpoint))
+		if err := os.MkdirAll(PathFor(mountpoint), 0750); err != nil {
+			return err
+		}
+
+		glog.Infof("Mounting device %q on %q", device, mountpoint)
+
+		err = safeFormatAndMount.FormatAndMount(device, mountpoint, fstype, options)
+		if err != nil {
+			return fmt.Errorf("error formatting and mounting disk %q on %q: %v", device, mountpoint, err)
+		}
+	} else {
+		glog.Infof("Device already mounted on %q, verifying it is our device", mountpoint)
+
+		if len(existing) != 1 {
+			glog.Infof("Existing mounts unexpected")
+
+			for i := range mounts {
+				m := &mounts[i]
+				glog.Infof("%s\t%s", m.Device, m.Path)
+			}
+
+			return fmt.Errorf("found multiple existing mounts of %q at %q", device, mountpoint)
+		} else {
+			glog.Infof("Found existing mount of %q at %q", device, mountpoint)
+		}
+	}
+
+	// If we're containerized we also want to mount the device (again) into our container
+	// We could also do this with mount propagation, but this is simple
+	if Containerized {
+		source := PathFor(device)
+		target := PathFor(mountpoint)
+		options := []string{}
+
+		mounter := mount.New("")
+
+		mountedDevice, _, err := mount.GetDeviceNameFromMount(mounter, target)
+		if err != nil {
+			return fmt.Errorf("error checking for mounts of %s inside container: %v", target, err)
+		}
+
+		if mountedDevice != "" {
+			// We check that it is the correct device.  We also tolerate /dev/X as well as /root/dev/X
+			if mountedDevice != source && mountedDevice != device {
+				return fmt.Errorf("device already mounted at %s, but is %s and we want %s or %s", target, mountedDevice, source, device)
+			}
+		} else {
+			glog.Infof("mounting inside container: %s -> %s", source, target)
+			if err := mounter.Mount(source, target, fstype, options); err != nil {
+				return fmt.Errorf("error mounting %s inside container at %s: %v", source, target, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// tmpfsVolumeDriver backs a volume with an in-memory tmpfs, for test clusters
+// that don't need persistence. Recognised Volume.DriverOptions:
+//   - "size": passed through to tmpfs as its "size=" mount option
+type tmpfsVolumeDriver struct{}
+
+var _ VolumeDriver = &tmpfsVolumeDriver{}
+
+func (d *tmpfsVolumeDriver) Mount(ctx context.Context, provider Volumes, volume *Volume, mountpoint string, fstype string) error {
+	options := []string{}
+	if size := volume.DriverOptions["size"]; size != "" {
+		options = append(options, "size="+size)
+	}
+
+	return mountIfNeeded("tmpfs", "tmpfs", mountpoint, options)
+}
+
+// bindVolumeDriver bind-mounts a pre-existing host path, for bare-metal
+// setups that provision the backing storage out of band. Recognised
+// Volume.DriverOptions:
+//   - "device": the host path to bind-mount (required)
+//   - "o": a comma-separated list of mount options, e.g. "nodev,noexec"
+type bindVolumeDriver struct{}
+
+var _ VolumeDriver = &bindVolumeDriver{}
+
+func (d *bindVolumeDriver) Mount(ctx context.Context, provider Volumes, volume *Volume, mountpoint string, fstype string) error {
+	device := volume.DriverOptions["device"]
+	if device == "" {
+		return fmt.Errorf("bind driver requires a %q option on volume %q", "device", volume.ProviderID)
+	}
+
+	options := []string{"bind"}
+	if o := volume.DriverOptions["o"]; o != "" {
+		options = append(options, o)
+	}
+
+	return mountIfNeeded(device, "", mountpoint, options)
+}
+
+// mountIfNeeded creates mountpoint if necessary and mounts source there with
+// the given fstype/options, unless something is already mounted there. Like
+// blockVolumeDriver, when we're containerized it mounts in the host mount
+// namespace first and then mounts source again, with the same fstype and
+// options, at PathFor(mountpoint) inside our own container. For a bind
+// source both mounts show the same host path; for tmpfs the container gets
+// its own tmpfs instance, separate from the one mounted on the host.
+func mountIfNeeded(source string, fstype string, mountpoint string, options []string) error {
+	var mounter mount.Interface
+	if Containerized {
+		mounter = mount.NewNsenterMounter()
+	} else {
+		mounter = mount.New("")
+	}
+
+	// Note that we don't use PathFor for operations going through mounter,
+	// because NewNsenterMounter will operate in the host
+	mounts, err := mounter.List()
+	if err != nil {
+		return fmt.Errorf("error listing existing mounts: %v", err)
+	}
+
+	alreadyMounted := false
+	for i := range mounts {
+		if mounts[i].Path == mountpoint {
+			alreadyMounted = true
+			break
+		}
+	}
+
+	if alreadyMounted {
+		glog.Infof("Found existing mount of %q at %q", source, mountpoint)
+	} else {
+		glog.Infof("Creating mount directory %q", PathFor(mountpoint))
+		if err := os.MkdirAll(PathFor(mountpoint), 0750); err != nil {
+			return err
+		}
+
+		glog.Infof("Mounting %q on %q (fstype=%q, options=%v)", source, mountpoint, fstype, options)
+		if err := mounter.Mount(source, mountpoint, fstype, options); err != nil {
+			return fmt.Errorf("error mounting %q on %q: %v", source, mountpoint, err)
+		}
+	}
+
+	// If we're containerized we also want to mount the volume (again) into our container
+	// We could also do this with mount propagation, but this is simple
+	if Containerized {
+		// source is a pseudo-filesystem keyword (e.g. "tmpfs") rather than a
+		// host path for drivers like tmpfsVolumeDriver; PathFor only makes
+		// sense for real paths, so leave those sources untranslated.
+		hostSource := source
+		if strings.HasPrefix(source, "/") {
+			hostSource = PathFor(source)
+		}
+		target := PathFor(mountpoint)
+
+		localMounter := mount.New("")
+
+		mountedSource, _, err := mount.GetDeviceNameFromMount(localMounter, target)
+		if err != nil {
+			return fmt.Errorf("error checking for mounts of %s inside container: %v", target, err)
+		}
+
+		if mountedSource != "" {
+			// We check that it is the correct source.  We also tolerate the raw source as well as /root/<source>
+			if mountedSource != hostSource && mountedSource != source {
+				return fmt.Errorf("volume already mounted at %s, but is %s and we want %s or %s", target, mountedSource, hostSource, source)
+			}
+		} else {
+			glog.Infof("mounting inside container: %s -> %s", hostSource, target)
+			if err := localMounter.Mount(hostSource, target, fstype, options); err != nil {
+				return fmt.Errorf("error mounting %s inside container at %s: %v", hostSource, target, err)
+			}
+		}
+	}
+
+	return nil
+}
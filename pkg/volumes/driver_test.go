@@ -0,0 +1,92 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"context"
+	"testing"
+)
+
+func TestVolumeDriverName_DefaultsToBlock(t *testing.T) {
+	v := &Volume{ProviderID: "vol-1"}
+	if name := volumeDriverName(v); name != DefaultVolumeDriver {
+		t.Errorf("expected default driver %q, got %q", DefaultVolumeDriver, name)
+	}
+
+	v.Driver = "tmpfs"
+	if name := volumeDriverName(v); name != "tmpfs" {
+		t.Errorf("expected driver %q, got %q", "tmpfs", name)
+	}
+}
+
+func TestVolumeDriverFor_UnknownDriver(t *testing.T) {
+	v := &Volume{ProviderID: "vol-1", Driver: "does-not-exist"}
+	if _, err := volumeDriverFor(v); err == nil {
+		t.Errorf("expected an error for an unknown driver")
+	}
+}
+
+func TestVolumeDriverFor_Builtins(t *testing.T) {
+	for _, name := range []string{"block", "tmpfs", "bind"} {
+		v := &Volume{ProviderID: "vol-1", Driver: name}
+		driver, err := volumeDriverFor(v)
+		if err != nil {
+			t.Errorf("unexpected error resolving driver %q: %v", name, err)
+		}
+		if driver == nil {
+			t.Errorf("expected a non-nil driver for %q", name)
+		}
+	}
+}
+
+func TestRegisterVolumeDriver(t *testing.T) {
+	called := false
+	RegisterVolumeDriver("test-driver", volumeDriverFunc(func(ctx context.Context, provider Volumes, volume *Volume, mountpoint string, fstype string) error {
+		called = true
+		return nil
+	}))
+	defer delete(volumeDrivers, "test-driver")
+
+	v := &Volume{ProviderID: "vol-1", Driver: "test-driver"}
+	driver, err := volumeDriverFor(v)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := driver.Mount(context.Background(), nil, v, "/mnt/x", ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !called {
+		t.Errorf("expected the registered driver's Mount to be called")
+	}
+}
+
+// volumeDriverFunc adapts a plain function to the VolumeDriver interface,
+// for tests that only care about dispatch.
+type volumeDriverFunc func(ctx context.Context, provider Volumes, volume *Volume, mountpoint string, fstype string) error
+
+func (f volumeDriverFunc) Mount(ctx context.Context, provider Volumes, volume *Volume, mountpoint string, fstype string) error {
+	return f(ctx, provider, volume, mountpoint, fstype)
+}
+
+func TestBindVolumeDriver_RequiresDeviceOption(t *testing.T) {
+	driver := &bindVolumeDriver{}
+	v := &Volume{ProviderID: "vol-1", MountName: "a", DriverOptions: map[string]string{}}
+
+	if err := driver.Mount(context.Background(), nil, v, "/mnt/a", ""); err == nil {
+		t.Errorf("expected an error when the bind driver is missing a %q option", "device")
+	}
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// EncryptionSpec describes how a Volume's backing device should be
+// encrypted at rest via LUKS. It is carried on Volume.Encryption; a nil
+// spec means the volume is mounted unencrypted, as before.
+type EncryptionSpec struct {
+	// KeySource identifies where to obtain the LUKS passphrase, e.g.
+	// "file:///etc/etcd-manager/luks.key", "aws-kms://<key-id>",
+	// "gcp-kms://<key-id>", or "env://ETCD_MANAGER_LUKS_KEY". Interpreting
+	// it is the job of the configured EncryptionKeyProvider.
+	KeySource string
+}
+
+// EncryptionKeyProvider resolves a Volume's EncryptionSpec to the actual key
+// bytes passed to cryptsetup, so that cloud-specific KMS integrations (AWS,
+// GCP, ...) can be added without the mount code needing to know about them.
+type EncryptionKeyProvider interface {
+	GetKey(volume *Volume) ([]byte, error)
+}
+
+// encryptionKeyProvider is consulted by blockVolumeDriver whenever a volume
+// carries an Encryption spec. It follows the same package-level
+// configuration pattern as Containerized: set once during startup.
+var encryptionKeyProvider EncryptionKeyProvider
+
+// SetEncryptionKeyProvider configures the EncryptionKeyProvider used to
+// resolve LUKS keys for encrypted volumes.
+func SetEncryptionKeyProvider(p EncryptionKeyProvider) {
+	encryptionKeyProvider = p
+}
+
+// mapperDeviceName is the /dev/mapper/<name> name we luksOpen a volume's
+// device to.
+func mapperDeviceName(volume *Volume) string {
+	return "etcd-manager-" + volume.MountName
+}
+
+// ensureLuksOpen makes sure device is luksOpen'd, formatting it with LUKS
+// first if it has never been formatted. It returns the /dev/mapper/<name>
+// path that should be formatted/mounted in place of the raw device.
+func ensureLuksOpen(device string, volume *Volume) (string, error) {
+	if encryptionKeyProvider == nil {
+		return "", fmt.Errorf("volume %q requests encryption, but no EncryptionKeyProvider is configured", volume.ProviderID)
+	}
+
+	key, err := encryptionKeyProvider.GetKey(volume)
+	if err != nil {
+		return "", fmt.Errorf("error getting encryption key for volume %q: %v", volume.ProviderID, err)
+	}
+
+	mapperName := mapperDeviceName(volume)
+	mapperPath := "/dev/mapper/" + mapperName
+
+	if _, err := os.Stat(mapperPath); err == nil {
+		glog.Infof("LUKS mapping %q is already open", mapperPath)
+		return mapperPath, nil
+	}
+
+	alreadyLuks, err := isLuks(device)
+	if err != nil {
+		return "", fmt.Errorf("error checking if %q is a LUKS device: %v", device, err)
+	}
+
+	if !alreadyLuks {
+		glog.Infof("Formatting %q as a new LUKS device", device)
+		if err := luksFormat(device, key); err != nil {
+			return "", fmt.Errorf("error formatting %q as LUKS: %v", device, err)
+		}
+	}
+
+	if err := luksOpen(device, mapperName, key); err != nil {
+		// We deliberately do not fall back to reformatting here: a failed
+		// luksOpen on a device we already know is LUKS almost certainly
+		// means the passphrase changed (or is wrong), and silently
+		// reformatting would destroy data.
+		return "", fmt.Errorf("error opening LUKS device %q (passphrase may have changed, header left intact): %v", device, err)
+	}
+
+	return mapperPath, nil
+}
+
+// closeLuks closes the mapper device opened by ensureLuksOpen, if any. It is
+// a no-op if the volume was never opened as LUKS.
+func closeLuks(volume *Volume) error {
+	mapperName := mapperDeviceName(volume)
+	if _, err := os.Stat("/dev/mapper/" + mapperName); os.IsNotExist(err) {
+		return nil
+	}
+	return luksClose(mapperName)
+}
+
+func isLuks(device string) (bool, error) {
+	cmd := exec.Command("cryptsetup", "isLuks", device)
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			// cryptsetup isLuks exits non-zero for "not a LUKS device"
+			_ = exitErr
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func luksFormat(device string, key []byte) error {
+	cmd := exec.Command("cryptsetup", "luksFormat", "--batch-mode", device)
+	cmd.Stdin = bytes.NewReader(key)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func luksOpen(device string, mapperName string, key []byte) error {
+	cmd := exec.Command("cryptsetup", "luksOpen", device, mapperName)
+	cmd.Stdin = bytes.NewReader(key)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func luksClose(mapperName string) error {
+	cmd := exec.Command("cryptsetup", "luksClose", mapperName)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMapperDeviceName(t *testing.T) {
+	v := &Volume{ProviderID: "vol-1", MountName: "main"}
+	if got, want := mapperDeviceName(v), "etcd-manager-main"; got != want {
+		t.Errorf("expected mapper name %q, got %q", want, got)
+	}
+}
+
+func TestEnsureLuksOpen_RequiresKeyProvider(t *testing.T) {
+	old := encryptionKeyProvider
+	encryptionKeyProvider = nil
+	defer func() { encryptionKeyProvider = old }()
+
+	v := &Volume{ProviderID: "vol-1", MountName: "main", Encryption: &EncryptionSpec{KeySource: "file:///dev/null"}}
+
+	if _, err := ensureLuksOpen("/dev/fake0", v); err == nil {
+		t.Errorf("expected an error when no EncryptionKeyProvider is configured")
+	}
+}
+
+type fakeEncryptionKeyProvider struct {
+	key []byte
+	err error
+}
+
+func (f *fakeEncryptionKeyProvider) GetKey(volume *Volume) ([]byte, error) {
+	return f.key, f.err
+}
+
+func TestEnsureLuksOpen_PropagatesKeyProviderError(t *testing.T) {
+	old := encryptionKeyProvider
+	defer func() { encryptionKeyProvider = old }()
+
+	SetEncryptionKeyProvider(&fakeEncryptionKeyProvider{err: errors.New("key unavailable")})
+
+	v := &Volume{ProviderID: "vol-1", MountName: "main", Encryption: &EncryptionSpec{KeySource: "file:///dev/null"}}
+
+	if _, err := ensureLuksOpen("/dev/fake0", v); err == nil {
+		t.Errorf("expected the key provider's error to propagate")
+	}
+}
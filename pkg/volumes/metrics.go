@@ -0,0 +1,165 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+// defaultMetricsCacheDuration is how long a statfs result is reused before
+// we re-stat the volume, to avoid stat storms on busy filesystems.
+const defaultMetricsCacheDuration = 60 * time.Second
+
+var (
+	volumeCapacityBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "etcd_manager_volume_capacity_bytes",
+		Help: "Total size in bytes of a mounted master volume",
+	}, []string{"provider_id", "mount_name"})
+
+	volumeAvailableBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "etcd_manager_volume_available_bytes",
+		Help: "Available (free for unprivileged users) bytes on a mounted master volume",
+	}, []string{"provider_id", "mount_name"})
+
+	volumeInodesFree = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "etcd_manager_volume_inodes_free",
+		Help: "Free inodes on a mounted master volume",
+	}, []string{"provider_id", "mount_name"})
+)
+
+func init() {
+	prometheus.MustRegister(volumeCapacityBytes)
+	prometheus.MustRegister(volumeAvailableBytes)
+	prometheus.MustRegister(volumeInodesFree)
+}
+
+// VolumeMetrics holds the statfs-derived usage of a single mounted volume.
+type VolumeMetrics struct {
+	CapacityBytes  int64
+	AvailableBytes int64
+	UsedBytes      int64
+	InodesFree     int64
+	InodesUsed     int64
+}
+
+// statfsVolumeMetrics statfs's path and fills in a VolumeMetrics, following
+// the same approach as the Kubernetes kubelet's pkg/volume/util/fs metrics
+// collector.
+func statfsVolumeMetrics(path string) (*VolumeMetrics, error) {
+	var buf unix.Statfs_t
+	if err := unix.Statfs(path, &buf); err != nil {
+		return nil, err
+	}
+
+	capacityBytes := int64(buf.Blocks) * int64(buf.Bsize)
+	availableBytes := int64(buf.Bavail) * int64(buf.Bsize)
+	usedBytes := capacityBytes - int64(buf.Bfree)*int64(buf.Bsize)
+
+	inodesFree := int64(buf.Ffree)
+	inodesUsed := int64(buf.Files) - int64(buf.Ffree)
+
+	return &VolumeMetrics{
+		CapacityBytes:  capacityBytes,
+		AvailableBytes: availableBytes,
+		UsedBytes:      usedBytes,
+		InodesFree:     inodesFree,
+		InodesUsed:     inodesUsed,
+	}, nil
+}
+
+// cachedVolumeMetrics statfs's a set of paths, reusing each path's previous
+// result until cacheDuration elapses, so a periodic metrics scrape doesn't
+// hammer the filesystem on every call. This mirrors the cached/statfs split
+// used by the Kubernetes volume metrics providers.
+type cachedVolumeMetrics struct {
+	mu            sync.Mutex
+	cacheDuration time.Duration
+	entries       map[string]*cachedVolumeMetricsEntry
+}
+
+type cachedVolumeMetricsEntry struct {
+	fetchedAt time.Time
+	value     *VolumeMetrics
+	err       error
+}
+
+func newCachedVolumeMetrics(cacheDuration time.Duration) *cachedVolumeMetrics {
+	if cacheDuration <= 0 {
+		cacheDuration = defaultMetricsCacheDuration
+	}
+	return &cachedVolumeMetrics{
+		cacheDuration: cacheDuration,
+		entries:       make(map[string]*cachedVolumeMetricsEntry),
+	}
+}
+
+func (c *cachedVolumeMetrics) get(path string) (*VolumeMetrics, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := c.entries[path]
+	if entry != nil && time.Since(entry.fetchedAt) < c.cacheDuration {
+		return entry.value, entry.err
+	}
+
+	value, err := statfsVolumeMetrics(path)
+	c.entries[path] = &cachedVolumeMetricsEntry{fetchedAt: time.Now(), value: value, err: err}
+	return value, err
+}
+
+// Metrics statfs's every currently-mounted master volume (through a cache,
+// refreshed at most once per k.metricsCacheDuration, defaulting to
+// defaultMetricsCacheDuration) and publishes the capacity/available/inode
+// gauges, keyed by ProviderID and MountName.
+func (k *VolumeMountController) Metrics() (map[string]*VolumeMetrics, error) {
+	k.mu.Lock()
+	mounted := make([]*Volume, 0, len(k.mounted))
+	for _, v := range k.mounted {
+		mounted = append(mounted, v)
+	}
+	k.mu.Unlock()
+
+	k.metricsOnce.Do(func() {
+		k.metricsCache = newCachedVolumeMetrics(k.metricsCacheDuration)
+	})
+
+	results := make(map[string]*VolumeMetrics, len(mounted))
+	var firstErr error
+	for _, v := range mounted {
+		m, err := k.metricsCache.get(v.Mountpoint)
+		if err != nil {
+			glog.Warningf("error statfs'ing volume %q at %q: %v", v.ProviderID, v.Mountpoint, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		volumeCapacityBytes.WithLabelValues(v.ProviderID, v.MountName).Set(float64(m.CapacityBytes))
+		volumeAvailableBytes.WithLabelValues(v.ProviderID, v.MountName).Set(float64(m.AvailableBytes))
+		volumeInodesFree.WithLabelValues(v.ProviderID, v.MountName).Set(float64(m.InodesFree))
+
+		results[v.ProviderID] = m
+	}
+
+	return results, firstErr
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStatfsVolumeMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statfs-test")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := statfsVolumeMetrics(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m.CapacityBytes <= 0 {
+		t.Errorf("expected a positive capacity, got %d", m.CapacityBytes)
+	}
+	if m.CapacityBytes < m.AvailableBytes {
+		t.Errorf("available bytes (%d) should not exceed capacity (%d)", m.AvailableBytes, m.CapacityBytes)
+	}
+}
+
+func TestStatfsVolumeMetrics_MissingPath(t *testing.T) {
+	if _, err := statfsVolumeMetrics("/this/path/should/not/exist/ever"); err == nil {
+		t.Errorf("expected an error statfs'ing a nonexistent path")
+	}
+}
+
+func TestCachedVolumeMetrics_ReusesWithinWindow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statfs-cache-test")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newCachedVolumeMetrics(time.Hour)
+
+	first, err := c.get(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	second, err := c.get(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if first != second {
+		t.Errorf("expected the cached entry to be reused within the cache window")
+	}
+}
+
+func TestCachedVolumeMetrics_RefetchesAfterExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statfs-cache-expiry-test")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newCachedVolumeMetrics(time.Millisecond)
+
+	first, err := c.get(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	second, err := c.get(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if first == second {
+		t.Errorf("expected a fresh entry to be fetched after the cache window expired")
+	}
+}
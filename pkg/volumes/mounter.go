@@ -17,8 +17,10 @@ limitations under the License.
 package volumes
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
@@ -26,199 +28,255 @@ import (
 )
 
 type VolumeMountController struct {
+	mu sync.Mutex
+
+	// mounted is the actual state: volumes we have successfully mounted, keyed by ProviderID
 	mounted map[string]*Volume
 
 	provider Volumes
+
+	// executor serializes attach/mount operations per-volume, while still
+	// allowing different volumes to be reconciled concurrently
+	executor *operationExecutor
+
+	// attachTimeout bounds how long we wait for a volume to attach/mount
+	// before giving up with ErrVolumeAttachTimeout; defaults to DefaultAttachTimeout.
+	attachTimeout time.Duration
+
+	// metricsCacheDuration is how long Metrics() reuses a volume's last statfs
+	// result before re-stat'ing it; defaultMetricsCacheDuration unless overridden
+	// via SetMetricsCacheDuration.
+	metricsCacheDuration time.Duration
+
+	// metricsCache caches statfs results used by Metrics(), lazily initialized
+	metricsOnce  sync.Once
+	metricsCache *cachedVolumeMetrics
+}
+
+// SetMetricsCacheDuration overrides how long Metrics() reuses a volume's
+// last statfs result before re-stat'ing it. Must be called before the first
+// call to Metrics().
+func (k *VolumeMountController) SetMetricsCacheDuration(d time.Duration) {
+	k.metricsCacheDuration = d
 }
 
 func newVolumeMountController(provider Volumes) *VolumeMountController {
 	c := &VolumeMountController{}
 	c.mounted = make(map[string]*Volume)
 	c.provider = provider
+	c.executor = newOperationExecutor()
+	c.attachTimeout = DefaultAttachTimeout
 	return c
 }
 
-func (k *VolumeMountController) mountMasterVolumes() ([]*Volume, error) {
-	// TODO: mount ephemeral volumes (particular on AWS)?
+// SetAttachTimeout overrides the deadline mountMasterVolumes enforces on
+// attach/mount operations (DefaultAttachTimeout if never called).
+func (k *VolumeMountController) SetAttachTimeout(d time.Duration) {
+	k.attachTimeout = d
+}
 
-	// Mount master volumes
-	attached, err := k.attachMasterVolumes()
-	if err != nil {
-		return nil, fmt.Errorf("unable to attach master volumes: %v", err)
-	}
+// operationExecutor guards against dispatching two concurrent operations
+// (attach/format/mount/unmount) for the same volume, while letting
+// operations for distinct volumes proceed in parallel.  This mirrors the
+// reconciler used by the kubelet's volumemanager: a periodic loop diffs
+// desired state against actual state and dispatches per-volume operations
+// through an executor rather than a single global lock.
+type operationExecutor struct {
+	mu      sync.Mutex
+	running map[string]bool
+}
 
-	for _, v := range attached {
-		if len(k.mounted) > 0 {
-			// We only attempt to mount a single volume
-			break
-		}
+func newOperationExecutor() *operationExecutor {
+	return &operationExecutor{running: make(map[string]bool)}
+}
 
-		existing := k.mounted[v.ProviderID]
-		if existing != nil {
-			continue
-		}
+// run executes fn for providerID unless an operation for that providerID is
+// already in flight, in which case it returns an error immediately so the
+// caller can retry on the next reconcile.
+func (e *operationExecutor) run(providerID string, fn func() error) error {
+	e.mu.Lock()
+	if e.running[providerID] {
+		e.mu.Unlock()
+		return fmt.Errorf("operation already in progress for volume %q", providerID)
+	}
+	e.running[providerID] = true
+	e.mu.Unlock()
 
-		glog.V(2).Infof("Master volume %q is attached at %q", v.ProviderID, v.LocalDevice)
+	defer func() {
+		e.mu.Lock()
+		delete(e.running, providerID)
+		e.mu.Unlock()
+	}()
 
-		mountpoint := "/mnt/" + v.MountName
+	return fn()
+}
 
-		// On ContainerOS, we mount to /mnt/disks instead (/mnt is readonly)
-		_, err := os.Stat(PathFor("/mnt/disks"))
-		if err != nil {
-			if !os.IsNotExist(err) {
-				return nil, fmt.Errorf("error checking for /mnt/disks: %v", err)
-			}
-		} else {
-			mountpoint = "/mnt/disks/" + v.MountName
-		}
+// mountMasterVolumes reconciles the desired set of master volumes (everything
+// returned by provider.FindVolumes) against the actual state (k.mounted).
+// Volumes are attached and mounted independently and in parallel, so that a
+// failure on one volume (e.g. one member of a split etcd-main/etcd-events
+// setup) doesn't block the others; we return whatever subset is successfully
+// mounted. Errors hit on the rest are logged, and an error is returned only
+// when no volume at all ends up mounted.
+//
+// ctx bounds the whole reconcile: callers can cancel it (e.g. on shutdown)
+// to abandon in-flight attach/mount work, and it is further bounded by
+// k.attachTimeout (DefaultAttachTimeout unless overridden via SetAttachTimeout).
+func (k *VolumeMountController) mountMasterVolumes(ctx context.Context) ([]*Volume, error) {
+	// TODO: mount ephemeral volumes (particular on AWS)?
 
-		glog.Infof("Doing safe-format-and-mount of %s to %s", v.LocalDevice, mountpoint)
-		fstype := ""
-		err = k.safeFormatAndMount(v, mountpoint, fstype)
-		if err != nil {
-			glog.Warningf("unable to mount master volume: %q", err)
-			continue
-		}
+	ctx, cancel := context.WithTimeout(ctx, k.attachTimeout)
+	defer cancel()
 
-		glog.Infof("mounted master volume %q on %s", v.ProviderID, mountpoint)
+	// Attach every volume in the desired set that isn't attached yet
+	attached, errs := k.attachMasterVolumes(ctx)
 
-		v.Mountpoint = PathFor(mountpoint)
-		k.mounted[v.ProviderID] = v
+	var toMount []*Volume
+	k.mu.Lock()
+	for _, v := range attached {
+		if k.mounted[v.ProviderID] == nil {
+			toMount = append(toMount, v)
+		}
+	}
+	k.mu.Unlock()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, v := range toMount {
+		wg.Add(1)
+		go func(v *Volume) {
+			defer wg.Done()
+			err := k.executor.run(v.ProviderID, func() error {
+				return k.mountMasterVolume(ctx, v)
+			})
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}(v)
 	}
+	wg.Wait()
 
 	var volumes []*Volume
+	k.mu.Lock()
 	for _, v := range k.mounted {
 		volumes = append(volumes, v)
 	}
-	return volumes, nil
-}
-
-func (k *VolumeMountController) safeFormatAndMount(volume *Volume, mountpoint string, fstype string) error {
-	// Wait for the device to show up
-	device := ""
-	for {
-		found, err := k.provider.FindMountedVolume(volume)
-		if err != nil {
-			return err
-		}
+	k.mu.Unlock()
 
-		if found != "" {
-			device = found
-			break
-		}
+	for _, err := range errs {
+		glog.Warningf("error reconciling master volumes: %v", err)
+	}
 
-		glog.Infof("Waiting for volume %q to be mounted", volume.ProviderID)
-		time.Sleep(1 * time.Second)
+	if len(volumes) == 0 && len(errs) > 0 {
+		return nil, fmt.Errorf("unable to mount any master volumes: %v", errs[0])
 	}
-	glog.Infof("Found volume %q mounted at device %q", volume.ProviderID, device)
 
-	safeFormatAndMount := &mount.SafeFormatAndMount{}
+	return volumes, nil
+}
 
-	if Containerized {
-		// Build mount & exec implementations that execute in the host namespaces
-		safeFormatAndMount.Interface = mount.NewNsenterMounter()
-		safeFormatAndMount.Exec = NewNsEnterExec()
+// mountMasterVolume formats (if needed) and mounts a single, already-attached
+// volume, recording it in k.mounted on success.
+func (k *VolumeMountController) mountMasterVolume(ctx context.Context, v *Volume) error {
+	glog.V(2).Infof("Master volume %q is attached at %q", v.ProviderID, v.LocalDevice)
 
-		// Note that we don't use PathFor for operations going through safeFormatAndMount,
-		// because NewNsenterMounter and NewNsEnterExec will operate in the host
-	} else {
-		safeFormatAndMount.Interface = mount.New("")
-		safeFormatAndMount.Exec = mount.NewOsExec()
-	}
+	mountpoint := "/mnt/" + v.MountName
 
-	// Check if it is already mounted
-	// TODO: can we now use IsLikelyNotMountPoint or IsMountPointMatch instead here
-	mounts, err := safeFormatAndMount.List()
+	// On ContainerOS, we mount to /mnt/disks instead (/mnt is readonly)
+	_, err := os.Stat(PathFor("/mnt/disks"))
 	if err != nil {
-		return fmt.Errorf("error listing existing mounts: %v", err)
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("error checking for /mnt/disks: %v", err)
+		}
+	} else {
+		mountpoint = "/mnt/disks/" + v.MountName
 	}
 
-	var existing []*mount.MountPoint
-	for i := range mounts {
-		m := &mounts[i]
-		glog.V(8).Infof("found existing mount: %v", m)
-		// Note: when containerized, we still list mounts in the host, so we don't need to call PathFor(mountpoint)
-		if m.Path == mountpoint {
-			existing = append(existing, m)
-		}
+	glog.Infof("Doing safe-format-and-mount of %s to %s", v.LocalDevice, mountpoint)
+	fstype := ""
+	if err := k.safeFormatAndMount(ctx, v, mountpoint, fstype); err != nil {
+		return fmt.Errorf("unable to mount master volume %q: %v", v.ProviderID, err)
 	}
 
-	// Mount only if isn't mounted already
-	if len(existing) == 0 {
-		options := []string{}
+	glog.Infof("mounted master volume %q on %s", v.ProviderID, mountpoint)
 
-		glog.Infof("Creating mount directory %q", PathFor(mountpoint))
-		if err := os.MkdirAll(PathFor(mountpoint), 0750); err != nil {
-			return err
-		}
+	v.Mountpoint = PathFor(mountpoint)
 
-		glog.Infof("Mounting device %q on %q", device, mountpoint)
+	k.mu.Lock()
+	k.mounted[v.ProviderID] = v
+	k.mu.Unlock()
 
-		err = safeFormatAndMount.FormatAndMount(device, mountpoint, fstype, options)
-		if err != nil {
-			return fmt.Errorf("error formatting and mounting disk %q on %q: %v", device, mountpoint, err)
-		}
-	} else {
-		glog.Infof("Device already mounted on %q, verifying it is our device", mountpoint)
+	return nil
+}
 
-		if len(existing) != 1 {
-			glog.Infof("Existing mounts unexpected")
+// UnmountVolume reverses mountMasterVolume: it unmounts a previously-mounted
+// master volume, closes its LUKS mapping (if it was encrypted), and drops it
+// from the actual state, so a later reconcile will attach/mount it fresh if
+// it's still desired.
+func (k *VolumeMountController) UnmountVolume(v *Volume) error {
+	k.mu.Lock()
+	_, mounted := k.mounted[v.ProviderID]
+	k.mu.Unlock()
+	if !mounted {
+		return nil
+	}
 
-			for i := range mounts {
-				m := &mounts[i]
-				glog.Infof("%s\t%s", m.Device, m.Path)
-			}
+	glog.Infof("Unmounting master volume %q from %s", v.ProviderID, v.Mountpoint)
 
-			return fmt.Errorf("found multiple existing mounts of %q at %q", device, mountpoint)
-		} else {
-			glog.Infof("Found existing mount of %q at %q", device, mountpoint)
-		}
+	mounter := mount.New("")
+	if err := mounter.Unmount(PathFor(v.Mountpoint)); err != nil {
+		return fmt.Errorf("error unmounting volume %q at %q: %v", v.ProviderID, v.Mountpoint, err)
 	}
 
-	// If we're containerized we also want to mount the device (again) into our container
-	// We could also do this with mount propagation, but this is simple
-	if Containerized {
-		source := PathFor(device)
-		target := PathFor(mountpoint)
-		options := []string{}
+	if v.Encryption != nil {
+		if err := closeLuks(v); err != nil {
+			return fmt.Errorf("error closing LUKS mapping for volume %q: %v", v.ProviderID, err)
+		}
+	}
 
-		mounter := mount.New("")
+	k.mu.Lock()
+	delete(k.mounted, v.ProviderID)
+	k.mu.Unlock()
 
-		mountedDevice, _, err := mount.GetDeviceNameFromMount(mounter, target)
-		if err != nil {
-			return fmt.Errorf("error checking for mounts of %s inside container: %v", target, err)
-		}
+	return nil
+}
 
-		if mountedDevice != "" {
-			// We check that it is the correct device.  We also tolerate /dev/X as well as /root/dev/X
-			if mountedDevice != source && mountedDevice != device {
-				return fmt.Errorf("device already mounted at %s, but is %s and we want %s or %s", target, mountedDevice, source, device)
-			}
-		} else {
-			glog.Infof("mounting inside container: %s -> %s", source, target)
-			if err := mounter.Mount(source, target, fstype, options); err != nil {
-				return fmt.Errorf("error mounting %s inside container at %s: %v", source, target, err)
-			}
-		}
+// safeFormatAndMount mounts volume at mountpoint, dispatching to the
+// VolumeDriver named by volume.Driver (defaulting to "block", the original
+// attach-a-block-device-and-mkfs-it behavior).
+func (k *VolumeMountController) safeFormatAndMount(ctx context.Context, volume *Volume, mountpoint string, fstype string) error {
+	driver, err := volumeDriverFor(volume)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	glog.Infof("Mounting volume %q at %q using %q driver", volume.ProviderID, mountpoint, volumeDriverName(volume))
+	return driver.Mount(ctx, k.provider, volume, mountpoint, fstype)
 }
 
-func (k *VolumeMountController) attachMasterVolumes() ([]*Volume, error) {
+// attachMasterVolumes attaches every volume in the desired set (as reported
+// by provider.FindVolumes) that isn't attached yet.  Each attach is
+// independent and is dispatched to its own goroutine (serialized per
+// ProviderID through k.executor), so a volume that is slow or failing to
+// attach doesn't hold up the others.  It returns every volume that ends up
+// attached - including ones that already were - plus the errors encountered
+// for the rest, so callers can proceed with a partial success.
+func (k *VolumeMountController) attachMasterVolumes(ctx context.Context) ([]*Volume, []error) {
 	volumes, err := k.provider.FindVolumes()
 	if err != nil {
-		return nil, err
+		return nil, []error{err}
 	}
 
 	var tryAttach []*Volume
 	var attached []*Volume
 	for _, v := range volumes {
-		if v.AttachedTo == "" {
-			tryAttach = append(tryAttach, v)
-		}
 		if v.LocalDevice != "" {
 			attached = append(attached, v)
+			continue
+		}
+		if v.AttachedTo == "" {
+			tryAttach = append(tryAttach, v)
 		}
 	}
 
@@ -226,27 +284,44 @@ func (k *VolumeMountController) attachMasterVolumes() ([]*Volume, error) {
 		return attached, nil
 	}
 
-	// Actually attempt the mounting
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
 	for _, v := range tryAttach {
-		if len(attached) > 0 {
-			// We only attempt to mount a single volume
-			break
-		}
+		wg.Add(1)
+		go func(v *Volume) {
+			defer wg.Done()
+
+			if ctx.Err() != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("%w: %v", ErrVolumeAttachTimeout, ctx.Err()))
+				mu.Unlock()
+				return
+			}
+
+			glog.V(2).Infof("Trying to attach master volume: %q", v.ProviderID)
 
-		glog.V(2).Infof("Trying to mount master volume: %q", v.ProviderID)
+			err := k.executor.run(v.ProviderID, func() error {
+				return k.provider.AttachVolume(v)
+			})
 
-		err := k.provider.AttachVolume(v)
-		if err != nil {
-			// We are racing with other instances here; this can happen
-			glog.Warningf("Error attaching volume %q: %v", v.ProviderID, err)
-		} else {
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				// We are racing with other instances here; this can happen
+				glog.Warningf("Error attaching volume %q: %v", v.ProviderID, err)
+				errs = append(errs, err)
+				return
+			}
 			if v.LocalDevice == "" {
-				glog.Fatalf("AttachVolume did not set LocalDevice")
+				errs = append(errs, fmt.Errorf("AttachVolume did not set LocalDevice for volume %q", v.ProviderID))
+				return
 			}
 			attached = append(attached, v)
-		}
+		}(v)
 	}
+	wg.Wait()
 
 	glog.V(2).Infof("Currently attached volumes: %v", attached)
-	return attached, nil
+	return attached, errs
 }
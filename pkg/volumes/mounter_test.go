@@ -0,0 +1,129 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeVolumes is a minimal, in-memory Volumes provider for exercising the
+// reconciler without touching real devices.
+type fakeVolumes struct {
+	mu      sync.Mutex
+	volumes []*Volume
+	// failAttach, if set, is returned by AttachVolume for volumes whose
+	// ProviderID is a key in the map.
+	failAttach map[string]error
+}
+
+func (f *fakeVolumes) FindVolumes() ([]*Volume, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]*Volume, len(f.volumes))
+	copy(out, f.volumes)
+	return out, nil
+}
+
+func (f *fakeVolumes) AttachVolume(v *Volume) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.failAttach[v.ProviderID]; err != nil {
+		return err
+	}
+	v.LocalDevice = "/dev/fake-" + v.ProviderID
+	return nil
+}
+
+func (f *fakeVolumes) FindMountedVolume(v *Volume) (string, error) {
+	return v.LocalDevice, nil
+}
+
+func TestAttachMasterVolumes_PartialSuccess(t *testing.T) {
+	provider := &fakeVolumes{
+		volumes: []*Volume{
+			{ProviderID: "vol-good-1", MountName: "a"},
+			{ProviderID: "vol-good-2", MountName: "b"},
+			{ProviderID: "vol-bad", MountName: "c"},
+		},
+		failAttach: map[string]error{
+			"vol-bad": fmt.Errorf("injected attach failure"),
+		},
+	}
+
+	k := newVolumeMountController(provider)
+
+	attached, errs := k.attachMasterVolumes(context.Background())
+
+	if len(attached) != 2 {
+		t.Errorf("expected 2 attached volumes, got %d: %v", len(attached), attached)
+	}
+	if len(errs) != 1 {
+		t.Errorf("expected 1 error, got %d: %v", len(errs), errs)
+	}
+	for _, v := range attached {
+		if v.ProviderID == "vol-bad" {
+			t.Errorf("vol-bad should not have attached")
+		}
+	}
+}
+
+func TestOperationExecutor_SerializesPerKey(t *testing.T) {
+	e := newOperationExecutor()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	go func() {
+		_ = e.run("vol-1", func() error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+
+	<-started
+
+	// A second operation on the same key should be rejected while the first is in flight.
+	if err := e.run("vol-1", func() error { return nil }); err == nil {
+		t.Errorf("expected operation on vol-1 to be rejected while one is already running")
+	}
+
+	// A different key should be unaffected.
+	ran := false
+	if err := e.run("vol-2", func() error { ran = true; return nil }); err != nil {
+		t.Errorf("unexpected error running operation on distinct key: %v", err)
+	}
+	if !ran {
+		t.Errorf("expected operation on vol-2 to run")
+	}
+
+	close(release)
+
+	// Give the first goroutine a moment to release the key, then confirm it's free again.
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if err := e.run("vol-1", func() error { return nil }); err == nil {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Errorf("expected vol-1 to become available again after its operation completed")
+}